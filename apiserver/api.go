@@ -37,14 +37,19 @@ import (
 )
 
 type apiHandler struct {
-	db    *freegeoip.DB
-	conf  *Config
-	cors  *cors.Cors
-	cache *memcache.Client
+	db       *freegeoip.DB
+	conf     *Config
+	cors     *cors.Cors
+	cache    *memcache.Client
+	prefetch *prefetcher
+	formats  *FormatRegistry
+	limiter  *keyRateLimiter
 }
 
 // NewHandler creates an http handler for the freegeoip server that
-// can be embedded in other servers.
+// can be embedded in other servers. When c.Formats is nil, it defaults
+// to NewFormatRegistry(). Pass a custom registry to add or override
+// output formats without forking this package.
 func NewHandler(c *Config) (http.Handler, error) {
 	db, err := openDB(c)
 	if err != nil {
@@ -55,15 +60,29 @@ func NewHandler(c *Config) (http.Handler, error) {
 		AllowedMethods:   []string{"GET"},
 		AllowCredentials: true,
 	})
-	f := &apiHandler{db: db, conf: c, cors: cf}
+	formats := c.Formats
+	if formats == nil {
+		formats = NewFormatRegistry()
+	}
+	f := &apiHandler{db: db, conf: c, cors: cf, formats: formats}
 	mc := httpmux.DefaultConfig
 	if err := f.config(&mc); err != nil {
 		return nil, err
 	}
 	mux := httpmux.NewHandler(&mc)
-	mux.GET("/csv/*host", f.register("csv", csvWriter))
-	mux.GET("/xml/*host", f.register("xml", xmlWriter))
-	mux.GET("/json/*host", f.register("json", jsonWriter))
+	for _, name := range f.formats.names() {
+		mux.GET("/"+name+"/*host", f.register(name))
+		if batchFormats[name] {
+			mux.POST("/"+name+"/batch", f.registerBatch(name))
+		}
+	}
+	if f.cache != nil && c.PrefetchTopN > 0 {
+		if c.PrefetchInterval <= 0 {
+			return nil, fmt.Errorf("freegeoip: PrefetchInterval must be > 0 when PrefetchTopN is set")
+		}
+		f.prefetch = newPrefetcher(f, c.PrefetchTopN, c.PrefetchInterval)
+		go f.prefetch.run(make(chan struct{}))
+	}
 	go f.watchEvents(db)
 	return mux, nil
 }
@@ -91,7 +110,12 @@ func (f *apiHandler) config(mc *httpmux.Config) error {
 		if err != nil {
 			return fmt.Errorf("failed to create rate limiter: %v", err)
 		}
-		mc.Use(rl.Handle)
+		store, err := f.conf.keyStore()
+		if err != nil {
+			return fmt.Errorf("failed to create key store: %v", err)
+		}
+		f.limiter = newKeyRateLimiter(rl, store)
+		mc.Use(f.limiter.Handle)
 	}
 	return nil
 }
@@ -135,13 +159,19 @@ func (f *apiHandler) metrics(next http.HandlerFunc) http.HandlerFunc {
 
 type writerFunc func(w io.Writer, r *http.Request, d *responseRecord)
 
-func (f *apiHandler) register(name string, writer writerFunc) http.HandlerFunc {
-	h := prometheus.InstrumentHandler(name, f.iplookup(name, writer))
+func (f *apiHandler) register(name string) http.HandlerFunc {
+	h := prometheus.InstrumentHandler(name, f.iplookup(name))
 	return f.cors.Handler(h).ServeHTTP
 }
 
-func (f *apiHandler) iplookup(format string, writer writerFunc) http.HandlerFunc {
+func (f *apiHandler) iplookup(format string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		rf, ok := f.formats.lookup(format)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writer, ct := rf.writer, rf.contentType
 		host := httpmux.Params(r).ByName("host")
 		if len(host) > 0 && host[0] == '/' {
 			host = host[1:]
@@ -154,11 +184,16 @@ func (f *apiHandler) iplookup(format string, writer writerFunc) http.HandlerFunc
 		}
 		if format == "json" && r.FormValue("callback") != "" {
 			format = "jsonp"
-			writer = jsonpWriter
+			writer, ct = jsonpWriter, "application/javascript"
+		}
+		lang := language(r)
+		if f.prefetch != nil {
+			f.prefetch.track(format, lang, host, writer)
 		}
-		b, err := f.fromCache(format, host)
+		field := r.FormValue("field")
+		b, err := f.fromCache(format, lang, host, field)
 		if err == nil {
-			w.Header().Set("Content-Type", contentType[format])
+			w.Header().Set("Content-Type", ct)
 			w.Header().Set("X-Database-Date", f.db.Date().Format(http.TimeFormat))
 			w.Write(b)
 			return
@@ -169,32 +204,24 @@ func (f *apiHandler) iplookup(format string, writer writerFunc) http.HandlerFunc
 			return
 		}
 		ip, q := ips[rand.Intn(len(ips))], &geoipQuery{}
-		err = f.db.Lookup(ip, &q.DefaultQuery)
+		err = f.db.Lookup(ip, q)
 		if err != nil {
 			http.Error(w, "Try again later.", http.StatusServiceUnavailable)
 			return
 		}
-		w.Header().Set("Content-Type", contentType[format])
+		w.Header().Set("Content-Type", ct)
 		w.Header().Set("X-Database-Date", f.db.Date().Format(http.TimeFormat))
-		// TODO: cache per language?
-		// resp := q.Record(ip, r.Header.Get("Accept-Language"))
 		bw := respBuff.Get().(*bytes.Buffer)
 		bw.Reset()
-		writer(bw, r, q.Record(ip, ""))
+		writer(bw, r, q.Record(ip, lang))
 		b = bw.Bytes()
-		f.toCache(format, host, b)
+		f.toCache(format, lang, host, field, b)
 		w.Write(b)
 		respBuff.Put(bw)
 	}
 }
 
 var (
-	contentType = map[string]string{
-		"csv":   "text/csv",
-		"xml":   "application/xml",
-		"json":  "application/json",
-		"jsonp": "application/javascript",
-	}
 	respBuff = &sync.Pool{
 		New: func() interface{} {
 			return bytes.NewBuffer(make([]byte, 0, 1<<10))
@@ -203,23 +230,45 @@ var (
 	errCacheNotAvailable = errors.New("cache not available")
 )
 
-func (f *apiHandler) fromCache(format, host string) ([]byte, error) {
+// responseCacheKey builds the cache key for a format/lang/host response.
+// txt's output also depends on the ?field= query parameter (see
+// txtWriter), so field is folded into its key; other formats ignore it,
+// since their output is field-independent.
+func responseCacheKey(format, lang, host, field string) string {
+	if format == "txt" && field != "" {
+		return path.Join(format, lang, host, field)
+	}
+	return path.Join(format, lang, host)
+}
+
+func (f *apiHandler) fromCache(format, lang, host, field string) ([]byte, error) {
+	return f.cacheGet(responseCacheKey(format, lang, host, field))
+}
+
+func (f *apiHandler) toCache(format, lang, host, field string, v []byte) error {
+	return f.cacheSet(responseCacheKey(format, lang, host, field), v)
+}
+
+// cacheGet and cacheSet are the raw cache accessors behind fromCache and
+// toCache; other keyspaces (e.g. batchRecordCacheKey) use these directly
+// instead of going through responseCacheKey's format/lang/host framing.
+func (f *apiHandler) cacheGet(key string) ([]byte, error) {
 	if f.cache == nil {
 		return nil, errCacheNotAvailable
 	}
-	v, err := f.cache.Get(path.Join(format, host))
+	v, err := f.cache.Get(key)
 	if err != nil {
 		return nil, err
 	}
 	return v.Value, err
 }
 
-func (f *apiHandler) toCache(format, host string, v []byte) error {
+func (f *apiHandler) cacheSet(key string, v []byte) error {
 	if f.cache == nil {
 		return errCacheNotAvailable
 	}
 	return f.cache.Set(&memcache.Item{
-		Key:   path.Join(format, host),
+		Key:   key,
 		Value: v,
 	})
 }
@@ -252,10 +301,15 @@ func jsonpWriter(w io.Writer, r *http.Request, d *responseRecord) {
 
 type geoipQuery struct {
 	freegeoip.DefaultQuery
+	ASN struct {
+		Number       uint   `maxminddb:"autonomous_system_number"`
+		Organization string `maxminddb:"autonomous_system_organization"`
+	}
 }
 
+// Record builds a responseRecord out of q. lang is expected to already be
+// a negotiated, supported language tag (see language in lang.go).
 func (q *geoipQuery) Record(ip net.IP, lang string) *responseRecord {
-	// TODO: parse accept-language value from lang.
 	if q.Country.Names[lang] == "" {
 		lang = "en"
 	}
@@ -269,6 +323,10 @@ func (q *geoipQuery) Record(ip net.IP, lang string) *responseRecord {
 		Latitude:    roundFloat(q.Location.Latitude, .5, 4),
 		Longitude:   roundFloat(q.Location.Longitude, .5, 4),
 		MetroCode:   q.Location.MetroCode,
+		ASNOrg:      q.ASN.Organization,
+	}
+	if q.ASN.Number > 0 {
+		r.ASN = fmt.Sprintf("AS%d", q.ASN.Number)
 	}
 	if len(q.Region) > 0 {
 		r.RegionCode = q.Region[0].ISOCode
@@ -303,6 +361,8 @@ type responseRecord struct {
 	Latitude    float64  `json:"latitude"`
 	Longitude   float64  `json:"longitude"`
 	MetroCode   uint     `json:"metro_code"`
+	ASN         string   `json:"asn"`
+	ASNOrg      string   `json:"asn_org"`
 }
 
 func (rr *responseRecord) String() string {
@@ -321,18 +381,22 @@ func (rr *responseRecord) String() string {
 		strconv.FormatFloat(rr.Latitude, 'f', 2, 64),
 		strconv.FormatFloat(rr.Longitude, 'f', 2, 64),
 		strconv.Itoa(int(rr.MetroCode)),
+		rr.ASN,
+		rr.ASNOrg,
 	})
 	w.Flush()
 	return b.String()
 }
 
-// openDB opens and returns the IP database file or URL.
+// openDB opens and returns the IP database file or URL. When c.ASNDB is set,
+// the returned freegeoip.DB also carries a GeoLite2-ASN reader so that
+// lookups can be augmented with ASN/organization data.
 func openDB(c *Config) (*freegeoip.DB, error) {
 	u, err := url.Parse(c.DB)
 	if err != nil || len(u.Scheme) == 0 {
-		return freegeoip.Open(c.DB)
+		return freegeoip.Open(c.DB, c.ASNDB)
 	}
-	return freegeoip.OpenURL(c.DB, c.UpdateInterval, c.RetryInterval)
+	return freegeoip.OpenURL(c.DB, c.ASNDB, c.UpdateInterval, c.RetryInterval)
 }
 
 // watchEvents logs and collect metrics of database events.
@@ -0,0 +1,34 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGeoipQueryRecordIncludesASN(t *testing.T) {
+	q := &geoipQuery{}
+	q.ASN.Number = 15169
+	q.ASN.Organization = "Google LLC"
+	r := q.Record(net.ParseIP("8.8.8.8"), "en")
+	if r.ASN != "AS15169" {
+		t.Errorf("ASN = %q, want %q", r.ASN, "AS15169")
+	}
+	if r.ASNOrg != "Google LLC" {
+		t.Errorf("ASNOrg = %q, want %q", r.ASNOrg, "Google LLC")
+	}
+}
+
+func TestGeoipQueryRecordOmitsASNWhenUnset(t *testing.T) {
+	q := &geoipQuery{}
+	r := q.Record(net.ParseIP("8.8.8.8"), "en")
+	if r.ASN != "" {
+		t.Errorf("ASN = %q, want empty", r.ASN)
+	}
+	if r.ASNOrg != "" {
+		t.Errorf("ASNOrg = %q, want empty", r.ASNOrg)
+	}
+}
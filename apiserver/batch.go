@@ -0,0 +1,188 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// batchWorkers bounds how many hosts of a single batch request are looked
+// up concurrently.
+const batchWorkers = 16
+
+// maxBatchBodyBytes bounds how much of a batch request body is read
+// before the host count is even validated, so an oversized payload can't
+// be fully buffered into memory first.
+const maxBatchBodyBytes = 1 << 20 // 1MiB
+
+// batchFormats lists the formats the batch endpoint is registered for.
+// Unlike single-host lookups, a batch response has to frame multiple
+// records as one document, and that framing is only defined for these
+// three; msgpack/yaml/txt batch responses are a follow-up.
+var batchFormats = map[string]bool{
+	"json": true,
+	"xml":  true,
+	"csv":  true,
+}
+
+// registerBatch wires up the POST /<format>/batch handler for format.
+func (f *apiHandler) registerBatch(format string) http.HandlerFunc {
+	return f.cors.Handler(f.batchLookup(format)).ServeHTTP
+}
+
+// batchLookup accepts a JSON array, or a newline-delimited list, of up to
+// conf.BatchLimit hosts and returns their responseRecords in the same
+// format and order, resolving and looking them up concurrently.
+func (f *apiHandler) batchLookup(format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rf, ok := f.formats.lookup(format)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		hosts, err := readBatchHosts(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes))
+		if err != nil {
+			status := http.StatusBadRequest
+			if strings.Contains(err.Error(), "too large") {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		limit := f.conf.BatchLimit
+		if limit <= 0 {
+			limit = 100
+		}
+		if len(hosts) == 0 || len(hosts) > limit {
+			http.Error(w, "batch must contain between 1 and "+strconv.Itoa(limit)+" hosts", http.StatusBadRequest)
+			return
+		}
+		// The Use middleware chain already charged one unit for this
+		// POST; charge the remaining hosts so a batch of n lookups
+		// costs the same as n individual requests would.
+		if f.limiter != nil && len(hosts) > 1 {
+			if !f.limiter.chargeExtra(w, r, len(hosts)-1) {
+				return
+			}
+		}
+		lang := language(r)
+		records := make([]*responseRecord, len(hosts))
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, batchWorkers)
+		for i, host := range hosts {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, host string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				records[i] = f.batchLookupHost(lang, host)
+			}(i, host)
+		}
+		wg.Wait()
+		w.Header().Set("Content-Type", rf.contentType)
+		w.Header().Set("X-Database-Date", f.db.Date().Format(http.TimeFormat))
+		writeBatch(w, format, rf.writer, records)
+	}
+}
+
+// batchRecordCacheKey namespaces the JSON records batchLookupHost caches
+// internally, separate from the per-format response cache iplookup uses
+// for single-host GETs (see responseCacheKey). Sharing that keyspace
+// would let a batch POST overwrite a cached GET response in a different
+// shape (a raw JSON record under a csv/xml cache key, say).
+func batchRecordCacheKey(lang, host string) string {
+	return "batch-record/" + lang + "/" + host
+}
+
+// batchLookupHost resolves and looks up a single host, consulting and
+// populating its own cache entry just like iplookup does, but keyed
+// independently of the requested batch format (see batchRecordCacheKey).
+func (f *apiHandler) batchLookupHost(lang, host string) *responseRecord {
+	key := batchRecordCacheKey(lang, host)
+	if b, err := f.cacheGet(key); err == nil {
+		var d responseRecord
+		if json.Unmarshal(b, &d) == nil {
+			return &d
+		}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return &responseRecord{IP: host}
+	}
+	q := &geoipQuery{}
+	if err := f.db.Lookup(ips[0], q); err != nil {
+		return &responseRecord{IP: ips[0].String()}
+	}
+	d := q.Record(ips[0], lang)
+	if b, err := json.Marshal(d); err == nil {
+		f.cacheSet(key, b)
+	}
+	return d
+}
+
+// readBatchHosts reads up to one batch request body, accepting either a
+// JSON array of hosts or a plain newline-delimited list.
+func readBatchHosts(body io.Reader) ([]string, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var hosts []string
+	if b[0] == '[' {
+		if err := json.Unmarshal(b, &hosts); err != nil {
+			return nil, err
+		}
+		return hosts, nil
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		host := strings.TrimSpace(sc.Text())
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, sc.Err()
+}
+
+// batchResponses is the root element wrapping a batch's xml records, so
+// the document has a single root instead of concatenated <Response>
+// siblings.
+type batchResponses struct {
+	XMLName   xml.Name          `xml:"Responses"`
+	Responses []*responseRecord `xml:"Response"`
+}
+
+// writeBatch encodes records as a single format-specific document: a
+// JSON array, an XML document with one <Responses> root, or one CSV
+// record per line. format is always one of batchFormats.
+func writeBatch(w io.Writer, format string, writer writerFunc, records []*responseRecord) {
+	switch format {
+	case "json":
+		json.NewEncoder(w).Encode(records)
+	case "xml":
+		x := xml.NewEncoder(w)
+		x.Indent("", "\t")
+		x.Encode(&batchResponses{Responses: records})
+		w.Write([]byte{'\n'})
+	default:
+		for _, d := range records {
+			writer(w, nil, d)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadBatchHostsJSONArray(t *testing.T) {
+	hosts, err := readBatchHosts(strings.NewReader(`["8.8.8.8", "1.1.1.1"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 || hosts[0] != "8.8.8.8" || hosts[1] != "1.1.1.1" {
+		t.Fatalf("unexpected hosts: %v", hosts)
+	}
+}
+
+func TestReadBatchHostsNewlineDelimited(t *testing.T) {
+	hosts, err := readBatchHosts(strings.NewReader("8.8.8.8\n\n1.1.1.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 || hosts[0] != "8.8.8.8" || hosts[1] != "1.1.1.1" {
+		t.Fatalf("unexpected hosts: %v", hosts)
+	}
+}
+
+func TestReadBatchHostsEmpty(t *testing.T) {
+	hosts, err := readBatchHosts(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 0 {
+		t.Fatalf("expected no hosts, got %v", hosts)
+	}
+}
+
+func TestWriteBatchJSONIsAnArray(t *testing.T) {
+	var buf bytes.Buffer
+	records := []*responseRecord{{IP: "8.8.8.8"}, {IP: "1.1.1.1"}}
+	writeBatch(&buf, "json", jsonWriter, records)
+	out := strings.TrimSpace(buf.String())
+	if !strings.HasPrefix(out, "[") || !strings.HasSuffix(out, "]") {
+		t.Fatalf("expected a JSON array, got %q", out)
+	}
+}
+
+func TestWriteBatchXMLHasSingleRoot(t *testing.T) {
+	var buf bytes.Buffer
+	records := []*responseRecord{{IP: "8.8.8.8"}, {IP: "1.1.1.1"}}
+	writeBatch(&buf, "xml", xmlWriter, records)
+	out := buf.String()
+	if strings.Count(out, "<Responses>") != 1 {
+		t.Fatalf("expected exactly one <Responses> root, got %q", out)
+	}
+	if strings.Count(out, "<Response>") != len(records) {
+		t.Fatalf("expected %d <Response> children, got %q", len(records), out)
+	}
+}
+
+func TestBatchLookupRejectsOversizedBody(t *testing.T) {
+	f := &apiHandler{formats: NewFormatRegistry(), conf: &Config{BatchLimit: 100}}
+	h := f.batchLookup("json")
+
+	huge := `["` + strings.Repeat("8.8.8.8,", maxBatchBodyBytes) + `8.8.8.8"]`
+	r := httptest.NewRequest("POST", "/json/batch", strings.NewReader(huge))
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestBatchLookupRejectsOverLimitHostCount(t *testing.T) {
+	f := &apiHandler{formats: NewFormatRegistry(), conf: &Config{BatchLimit: 2}}
+	h := f.batchLookup("json")
+
+	r := httptest.NewRequest("POST", "/json/batch", strings.NewReader(`["8.8.8.8","1.1.1.1","9.9.9.9"]`))
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestBatchLookupChargesRateLimiterPerHost(t *testing.T) {
+	f := &apiHandler{
+		formats: NewFormatRegistry(),
+		conf:    &Config{BatchLimit: 100},
+		limiter: newKeyRateLimiter(newTestRateLimiter(1), nil),
+	}
+	h := f.batchLookup("json")
+
+	// 3 hosts charge 2 extra units (the 1st is assumed already charged by
+	// the Use middleware chain) against a limiter whose quota is 1, so
+	// the request must be rejected before any lookups happen.
+	r := httptest.NewRequest("POST", "/json/batch", strings.NewReader(`["8.8.8.8","1.1.1.1","9.9.9.9"]`))
+	r.RemoteAddr = "5.6.7.8:1234"
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if w.Code == http.StatusOK {
+		t.Fatalf("expected the batch to be throttled once its per-host charge exceeded the limiter's quota, got 200 body %q", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "8.8.8.8") {
+		t.Fatalf("expected no batch output once throttled, got %q", w.Body.String())
+	}
+}
+
+func TestBatchRecordCacheKeyIsIndependentOfFormat(t *testing.T) {
+	if got, want := batchRecordCacheKey("en", "8.8.8.8"), "batch-record/en/8.8.8.8"; got != want {
+		t.Errorf("batchRecordCacheKey = %q, want %q", got, want)
+	}
+	// The key must never collide with responseCacheKey's per-format
+	// keyspace, regardless of the requested batch format.
+	for _, format := range []string{"json", "xml", "csv"} {
+		if got := responseCacheKey(format, "en", "8.8.8.8", ""); got == batchRecordCacheKey("en", "8.8.8.8") {
+			t.Errorf("batch cache key collides with responseCacheKey(%q, ...): %q", format, got)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/vmihailenco/msgpack"
+	"gopkg.in/yaml.v2"
+)
+
+// registeredFormat pairs a writerFunc with the content type it produces,
+// so embedders can add output formats beyond the built-in ones.
+type registeredFormat struct {
+	contentType string
+	writer      writerFunc
+}
+
+// FormatRegistry maps format names (as used in the URL, e.g. "json") to
+// their writerFunc and content type. NewFormatRegistry seeds it with the
+// built-in formats; embedders can Register their own on it and pass it
+// as Config.Formats to NewHandler to extend or override them.
+type FormatRegistry struct {
+	mu      sync.RWMutex
+	formats map[string]registeredFormat
+}
+
+// NewFormatRegistry returns a registry pre-loaded with freegeoip's
+// built-in output formats: csv, xml, json, msgpack, yaml and txt.
+func NewFormatRegistry() *FormatRegistry {
+	fr := &FormatRegistry{formats: make(map[string]registeredFormat)}
+	fr.Register("csv", "text/csv", csvWriter)
+	fr.Register("xml", "application/xml", xmlWriter)
+	fr.Register("json", "application/json", jsonWriter)
+	fr.Register("msgpack", "application/x-msgpack", msgpackWriter)
+	fr.Register("yaml", "application/x-yaml", yamlWriter)
+	fr.Register("txt", "text/plain", txtWriter)
+	return fr
+}
+
+// Register adds or replaces the writerFunc and content type used for
+// name. It's safe to call concurrently, but is normally done once at
+// startup before NewHandler wires up the routes.
+func (fr *FormatRegistry) Register(name, contentType string, writer writerFunc) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.formats[name] = registeredFormat{contentType: contentType, writer: writer}
+}
+
+func (fr *FormatRegistry) lookup(name string) (registeredFormat, bool) {
+	fr.mu.RLock()
+	defer fr.mu.RUnlock()
+	rf, ok := fr.formats[name]
+	return rf, ok
+}
+
+// names returns the registered format names, used to wire up routes.
+func (fr *FormatRegistry) names() []string {
+	fr.mu.RLock()
+	defer fr.mu.RUnlock()
+	names := make([]string, 0, len(fr.formats))
+	for name := range fr.formats {
+		names = append(names, name)
+	}
+	return names
+}
+
+func msgpackWriter(w io.Writer, r *http.Request, d *responseRecord) {
+	b, err := msgpack.Marshal(d)
+	if err == nil {
+		w.Write(b)
+	}
+}
+
+func yamlWriter(w io.Writer, r *http.Request, d *responseRecord) {
+	b, err := yaml.Marshal(d)
+	if err == nil {
+		w.Write(b)
+	}
+}
+
+// txtWriter prints a single field of the response record, selected via
+// the ?field= query parameter (defaults to "country_code"). It's meant
+// for quick lookups from the shell, e.g. curl freegeoip.app/txt/8.8.8.8.
+func txtWriter(w io.Writer, r *http.Request, d *responseRecord) {
+	field := r.FormValue("field")
+	if field == "" {
+		field = "country_code"
+	}
+	v := reflect.ValueOf(d).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("json")
+		if tag != field {
+			continue
+		}
+		fmt.Fprintf(w, "%v\n", v.Field(i).Interface())
+		return
+	}
+	fmt.Fprintf(w, "unknown field %q\n", field)
+}
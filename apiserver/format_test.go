@@ -0,0 +1,68 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFormatRegistryBuiltins(t *testing.T) {
+	fr := NewFormatRegistry()
+	for _, name := range []string{"csv", "xml", "json", "msgpack", "yaml", "txt"} {
+		if _, ok := fr.lookup(name); !ok {
+			t.Errorf("expected built-in format %q to be registered", name)
+		}
+	}
+	if _, ok := fr.lookup("does-not-exist"); ok {
+		t.Error("lookup of an unregistered format should fail")
+	}
+}
+
+func TestFormatRegistryRegisterOverrides(t *testing.T) {
+	fr := NewFormatRegistry()
+	called := false
+	fr.Register("json", "application/x-custom-json", func(w io.Writer, r *http.Request, d *responseRecord) {
+		called = true
+	})
+	rf, ok := fr.lookup("json")
+	if !ok {
+		t.Fatal("expected json to still be registered after override")
+	}
+	if rf.contentType != "application/x-custom-json" {
+		t.Errorf("contentType = %q, want the overridden value", rf.contentType)
+	}
+	rf.writer(&bytes.Buffer{}, httptest.NewRequest("GET", "/json/8.8.8.8", nil), &responseRecord{})
+	if !called {
+		t.Error("expected the overridden writer to be used")
+	}
+}
+
+func TestResponseCacheKeyFoldsFieldForTxt(t *testing.T) {
+	if got, want := responseCacheKey("txt", "en", "8.8.8.8", "city"), "txt/en/8.8.8.8/city"; got != want {
+		t.Errorf("responseCacheKey(txt,...) = %q, want %q", got, want)
+	}
+	if got, want := responseCacheKey("txt", "en", "8.8.8.8", ""), "txt/en/8.8.8.8"; got != want {
+		t.Errorf("responseCacheKey(txt, field=\"\") = %q, want %q", got, want)
+	}
+	if got, want := responseCacheKey("json", "en", "8.8.8.8", "city"), "json/en/8.8.8.8"; got != want {
+		t.Errorf("responseCacheKey(json,...) should ignore field, got %q, want %q", got, want)
+	}
+}
+
+func TestTxtWriterDiffersByField(t *testing.T) {
+	d := &responseRecord{CountryCode: "US", City: "Mountain View"}
+	var cityBuf, countryBuf bytes.Buffer
+	r := httptest.NewRequest("GET", "/txt/8.8.8.8?field=city", nil)
+	txtWriter(&cityBuf, r, d)
+	r2 := httptest.NewRequest("GET", "/txt/8.8.8.8?field=country_code", nil)
+	txtWriter(&countryBuf, r2, d)
+	if cityBuf.String() == countryBuf.String() {
+		t.Errorf("expected different output per field, got %q for both", cityBuf.String())
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fiorix/go-redis/redis"
+	"github.com/go-web/httprl"
+)
+
+// KeyStore resolves an API key to the request-per-interval limit of its
+// tier. Lookup returns ok=false for unknown keys, which causes the
+// caller to fall back to the regular IP-based limit.
+type KeyStore interface {
+	Lookup(key string) (limit int32, ok bool)
+}
+
+// apiKey extracts the API key from the Authorization header (as a Bearer
+// token) or the "key" query parameter. It returns "" when neither is
+// present.
+func apiKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.FormValue("key")
+}
+
+// FileKeyStore is a KeyStore backed by a flat file of "key,limit" lines,
+// loaded once at startup. It's meant for small, mostly-static tiers of
+// keys that don't warrant a database.
+type FileKeyStore struct {
+	mu    sync.RWMutex
+	limit map[string]int32
+}
+
+// NewFileKeyStore loads key/limit pairs from a CSV-like file where each
+// line is "key,limit". Blank lines and lines starting with "#" are
+// ignored.
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &FileKeyStore{limit: make(map[string]int32)}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ",", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("keystore: malformed line %q", line)
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("keystore: %v", err)
+		}
+		s.limit[strings.TrimSpace(parts[0])] = int32(limit)
+	}
+	return s, sc.Err()
+}
+
+// Lookup implements KeyStore.
+func (s *FileKeyStore) Lookup(key string) (int32, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	limit, ok := s.limit[key]
+	return limit, ok
+}
+
+// RedisKeyStore is a KeyStore backed by redis, where each key's limit is
+// stored as a plain integer value under "freegeoip:key:<key>". It suits
+// operators who provision keys dynamically.
+type RedisKeyStore struct {
+	rc *redis.Client
+}
+
+// NewRedisKeyStore returns a RedisKeyStore using rc.
+func NewRedisKeyStore(rc *redis.Client) *RedisKeyStore {
+	return &RedisKeyStore{rc: rc}
+}
+
+// Lookup implements KeyStore.
+func (s *RedisKeyStore) Lookup(key string) (int32, bool) {
+	v, err := s.rc.Get("freegeoip:key:" + key)
+	if err != nil || v == "" {
+		return 0, false
+	}
+	limit, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int32(limit), true
+}
+
+// keyStore builds the KeyStore configured for c, if any. It returns a nil
+// KeyStore, and no error, when no key store backend is configured, in
+// which case all requests are rate-limited by IP as before.
+func (c *Config) keyStore() (KeyStore, error) {
+	switch c.KeyStoreBackend {
+	case "":
+		return nil, nil
+	case "file":
+		return NewFileKeyStore(c.KeyStoreFile)
+	case "redis":
+		addrs := strings.Split(c.RedisAddr, ",")
+		rc, err := redis.NewClient(addrs...)
+		if err != nil {
+			return nil, err
+		}
+		rc.SetTimeout(c.RedisTimeout)
+		return NewRedisKeyStore(rc), nil
+	default:
+		return nil, fmt.Errorf("unsupported key store backend: %q", c.KeyStoreBackend)
+	}
+}
+
+// keyRateLimiter dispatches each request to either a per-tier rate
+// limiter, when the request carries a known API key, or the regular
+// IP-based limiter otherwise. Tier limiters share the IP limiter's
+// backend, so keyed and anonymous buckets live side by side in the same
+// map/redis/memcache store.
+type keyRateLimiter struct {
+	store   KeyStore
+	ipLimit *httprl.RateLimiter
+
+	mu    sync.Mutex
+	tiers map[int32]*httprl.RateLimiter
+}
+
+func newKeyRateLimiter(ipLimit *httprl.RateLimiter, store KeyStore) *keyRateLimiter {
+	return &keyRateLimiter{
+		ipLimit: ipLimit,
+		store:   store,
+		tiers:   make(map[int32]*httprl.RateLimiter),
+	}
+}
+
+// Handle wraps next with rate limiting: an authenticated key with a
+// known tier is limited by its own bucket at that tier's limit; everything else falls
+// back to the IP-based limiter.
+func (k *keyRateLimiter) Handle(next http.HandlerFunc) http.HandlerFunc {
+	ipLimited := k.ipLimit.Handle(next)
+	if k.store == nil {
+		return ipLimited
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := apiKey(r)
+		if key == "" {
+			ipLimited(w, r)
+			return
+		}
+		limit, ok := k.store.Lookup(key)
+		if !ok {
+			ipLimited(w, r)
+			return
+		}
+		rl := k.tierLimiter(limit)
+		// Buckets are keyed by remote address in httprl, so bucket keyed
+		// requests under their API key rather than their source IP. The
+		// key goes in the host part, so splitting off the port keeps it.
+		keyed := new(http.Request)
+		*keyed = *r
+		keyed.RemoteAddr = net.JoinHostPort("key:"+key, "0")
+		rl.Handle(next)(w, keyed)
+	}
+}
+
+// chargeExtra runs n additional rate-limit checks for r's bucket, on top
+// of whatever the Handle middleware already counted for this request.
+// It's used by the batch endpoint so that a single POST covering n hosts
+// is charged as n units rather than one. It reports whether every check
+// passed; the first check that fails has already written the limiter's
+// standard error response to w.
+func (k *keyRateLimiter) chargeExtra(w http.ResponseWriter, r *http.Request, n int) bool {
+	for i := 0; i < n; i++ {
+		passed := false
+		k.Handle(func(http.ResponseWriter, *http.Request) { passed = true })(w, r)
+		if !passed {
+			return false
+		}
+	}
+	return true
+}
+
+func (k *keyRateLimiter) tierLimiter(limit int32) *httprl.RateLimiter {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	rl, ok := k.tiers[limit]
+	if !ok {
+		rl = &httprl.RateLimiter{
+			Backend:  k.ipLimit.Backend,
+			Limit:    limit,
+			Interval: k.ipLimit.Interval,
+			ErrorLog: k.ipLimit.ErrorLog,
+		}
+		k.tiers[limit] = rl
+	}
+	return rl
+}
@@ -0,0 +1,134 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-web/httprl"
+)
+
+// fakeKeyStore is an in-memory KeyStore for tests.
+type fakeKeyStore map[string]int32
+
+func (s fakeKeyStore) Lookup(key string) (int32, bool) {
+	limit, ok := s[key]
+	return limit, ok
+}
+
+func newTestRateLimiter(limit int32) *httprl.RateLimiter {
+	m := httprl.NewMap(1)
+	m.Start()
+	return &httprl.RateLimiter{
+		Backend:  m,
+		Limit:    limit,
+		Interval: 60,
+	}
+}
+
+func TestKeyRateLimiterFallsBackToIPForUnknownKey(t *testing.T) {
+	k := newKeyRateLimiter(newTestRateLimiter(1), fakeKeyStore{"known": 5})
+	called := false
+	h := k.Handle(func(http.ResponseWriter, *http.Request) { called = true })
+
+	r := httptest.NewRequest("GET", "/json/8.8.8.8?key=unknown", nil)
+	r.RemoteAddr = "1.2.3.4:1234"
+	h(httptest.NewRecorder(), r)
+	if !called {
+		t.Fatal("expected an unknown key to fall back to the IP limiter and still be allowed")
+	}
+}
+
+func TestKeyRateLimiterFallsBackToIPWhenNoKeyPresent(t *testing.T) {
+	k := newKeyRateLimiter(newTestRateLimiter(1), fakeKeyStore{"known": 5})
+	called := false
+	h := k.Handle(func(http.ResponseWriter, *http.Request) { called = true })
+
+	r := httptest.NewRequest("GET", "/json/8.8.8.8", nil)
+	r.RemoteAddr = "1.2.3.4:1234"
+	h(httptest.NewRecorder(), r)
+	if !called {
+		t.Fatal("expected a request without any key to fall back to the IP limiter and still be allowed")
+	}
+}
+
+func TestKeyRateLimiterGivesEachKeyAnIndependentBucket(t *testing.T) {
+	store := fakeKeyStore{"a": 1, "b": 1}
+	k := newKeyRateLimiter(newTestRateLimiter(100), store)
+	next := func(http.ResponseWriter, *http.Request) {}
+
+	reqFor := func(key string) *http.Request {
+		r := httptest.NewRequest("GET", "/json/8.8.8.8?key="+key, nil)
+		r.RemoteAddr = "5.6.7.8:5678"
+		return r
+	}
+
+	// Exhaust key "a"'s single-request tier quota.
+	k.Handle(next)(httptest.NewRecorder(), reqFor("a"))
+	k.Handle(next)(httptest.NewRecorder(), reqFor("a"))
+
+	// Key "b" shares the same tier (limit=1) but must get its own bucket.
+	allowed := false
+	k.Handle(func(http.ResponseWriter, *http.Request) { allowed = true })(httptest.NewRecorder(), reqFor("b"))
+	if !allowed {
+		t.Fatal("key \"b\" should not be throttled by key \"a\"'s usage of the same tier limit")
+	}
+}
+
+func TestFileKeyStoreLookup(t *testing.T) {
+	f, err := ioutil.TempFile("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\nabc123,10\ndef456,100\n")
+	f.Close()
+
+	s, err := NewFileKeyStore(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit, ok := s.Lookup("abc123"); !ok || limit != 10 {
+		t.Errorf("Lookup(abc123) = %d, %v; want 10, true", limit, ok)
+	}
+	if limit, ok := s.Lookup("def456"); !ok || limit != 100 {
+		t.Errorf("Lookup(def456) = %d, %v; want 100, true", limit, ok)
+	}
+	if _, ok := s.Lookup("nope"); ok {
+		t.Error("Lookup of an unknown key should return ok=false")
+	}
+}
+
+func TestFileKeyStoreMalformedLine(t *testing.T) {
+	f, err := ioutil.TempFile("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("abc123-missing-a-limit\n")
+	f.Close()
+
+	if _, err := NewFileKeyStore(f.Name()); err == nil {
+		t.Fatal("expected a malformed line to produce an error")
+	}
+}
+
+func TestFileKeyStoreMalformedLimit(t *testing.T) {
+	f, err := ioutil.TempFile("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("abc123,not-a-number\n")
+	f.Close()
+
+	if _, err := NewFileKeyStore(f.Name()); err == nil {
+		t.Fatal("expected a non-numeric limit to produce an error")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// supportedLanguages lists the locales available in MaxMind's GeoLite2
+// City database. Keep in sync with the "names" languages shipped in the
+// database being served.
+var supportedLanguages = map[string]bool{
+	"de":    true,
+	"en":    true,
+	"es":    true,
+	"fr":    true,
+	"ja":    true,
+	"pt-BR": true,
+	"ru":    true,
+	"zh-CN": true,
+}
+
+// supportedLanguagesLower indexes supportedLanguages by lowercased tag,
+// so lookups can accept the case variants real clients send (e.g.
+// "pt-br", "zh-cn") and still resolve to the canonical tag used by the
+// database and the response cache.
+var supportedLanguagesLower = func() map[string]string {
+	m := make(map[string]string, len(supportedLanguages))
+	for tag := range supportedLanguages {
+		m[strings.ToLower(tag)] = tag
+	}
+	return m
+}()
+
+// canonicalLanguage returns the canonical supportedLanguages tag for tag,
+// matched case-insensitively.
+func canonicalLanguage(tag string) (string, bool) {
+	canon, ok := supportedLanguagesLower[strings.ToLower(tag)]
+	return canon, ok
+}
+
+// language negotiates the response language for r. A "lang" query
+// parameter takes precedence over the Accept-Language header. It falls
+// back to "en" when nothing matches a supported locale.
+func language(r *http.Request) string {
+	if lang := r.FormValue("lang"); lang != "" {
+		if canon, ok := canonicalLanguage(lang); ok {
+			return canon
+		}
+	}
+	return parseAcceptLanguage(r.Header.Get("Accept-Language"))
+}
+
+// acceptLanguage is a single entry of a parsed Accept-Language header,
+// e.g. "pt-BR;q=0.8".
+type acceptLanguage struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage implements the relevant subset of RFC 7231 section
+// 5.3.5: it parses language ranges and their quality values, and returns
+// the highest-priority supported language. It returns "en" when the
+// header is empty or no range matches a supported language.
+func parseAcceptLanguage(header string) string {
+	if header == "" {
+		return "en"
+	}
+	var langs []acceptLanguage
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		tag, q := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			tag = strings.TrimSpace(part[:i])
+			for _, param := range strings.Split(part[i+1:], ";") {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "q=") {
+					continue
+				}
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if tag == "" || q <= 0 {
+			continue
+		}
+		langs = append(langs, acceptLanguage{tag: tag, q: q})
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	for _, l := range langs {
+		lower := strings.ToLower(l.tag)
+		if lower == "*" {
+			continue
+		}
+		if canon, ok := canonicalLanguage(lower); ok {
+			return canon
+		}
+		// Fall back between a primary range and a supported locale that
+		// extends it, in either direction (e.g. "pt" -> "pt-BR",
+		// "en-US" -> "en"). Sibling regions such as "pt-PT" don't match.
+		for tagLower, canon := range supportedLanguagesLower {
+			if strings.HasPrefix(tagLower, lower+"-") || strings.HasPrefix(lower, tagLower+"-") {
+				return canon
+			}
+		}
+	}
+	return "en"
+}
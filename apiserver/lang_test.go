@@ -0,0 +1,54 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"fr", "fr"},
+		{"pt-BR", "pt-BR"},
+		{"pt-br", "pt-BR"},
+		{"ZH-CN", "zh-CN"},
+		{"pt", "pt-BR"},
+		{"de;q=0.2,fr;q=0.8", "fr"},
+		{"*", "en"},
+		{"xx-XX", "en"},
+	}
+	for _, tt := range tests {
+		if got := parseAcceptLanguage(tt.header); got != tt.want {
+			t.Errorf("parseAcceptLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	tests := []struct {
+		url    string
+		header string
+		want   string
+	}{
+		{"/json/8.8.8.8?lang=pt-BR", "", "pt-BR"},
+		{"/json/8.8.8.8?lang=pt-br", "", "pt-BR"},
+		{"/json/8.8.8.8?lang=xx", "fr", "fr"},
+		{"/json/8.8.8.8", "zh-cn", "zh-CN"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("Accept-Language", tt.header)
+		}
+		if got := language(r); got != tt.want {
+			t.Errorf("language(%q, Accept-Language=%q) = %q, want %q", tt.url, tt.header, got, tt.want)
+		}
+	}
+}
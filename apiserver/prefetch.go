@@ -0,0 +1,147 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	prefetchHitCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "freegeoip",
+		Name:      "prefetch_hit_total",
+		Help:      "Count of successful prefetch refreshes.",
+	})
+	prefetchMissCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "freegeoip",
+		Name:      "prefetch_miss_total",
+		Help:      "Count of prefetch refreshes that failed to resolve or look up the host.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(prefetchHitCounter)
+	prometheus.MustRegister(prefetchMissCounter)
+}
+
+// prefetchEntry tracks how often a given format/lang/host combination is
+// requested, and carries what's needed to redo the lookup and caching
+// pipeline ahead of cache expiration.
+type prefetchEntry struct {
+	format, lang, host string
+	writer             writerFunc
+	count              int64
+}
+
+// maxPrefetchEntriesFactor bounds how many distinct (format, lang, host)
+// keys the tracker will hold between rounds, as a multiple of topN, so a
+// burst of one-off hosts (or an attacker deliberately varying the host)
+// can't grow entries without bound for the whole interval window.
+const maxPrefetchEntriesFactor = 10
+
+// prefetcher keeps a rolling, size-bounded count of the most frequently
+// requested hosts and re-runs their lookups on every interval tick,
+// rewriting their cache entries so that popular queries keep hitting a
+// warm cache. The refresh timing is not tied to any cache entry's expiry.
+type prefetcher struct {
+	f        *apiHandler
+	topN     int
+	interval time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*prefetchEntry
+}
+
+func newPrefetcher(f *apiHandler, topN int, interval time.Duration) *prefetcher {
+	return &prefetcher{
+		f:        f,
+		topN:     topN,
+		interval: interval,
+		entries:  make(map[string]*prefetchEntry),
+	}
+}
+
+// track records a request for host, so it can be considered for the next
+// prefetch round. jsonp and txt are skipped: their output depends on
+// query parameters (callback, field) that a bare refresh request can't
+// reproduce, so replaying them would overwrite a good cache entry with a
+// broken one.
+func (p *prefetcher) track(format, lang, host string, writer writerFunc) {
+	if format == "jsonp" || format == "txt" {
+		return
+	}
+	key := format + "\x00" + lang + "\x00" + host
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[key]
+	if !ok {
+		if len(p.entries) >= p.topN*maxPrefetchEntriesFactor {
+			return
+		}
+		e = &prefetchEntry{format: format, lang: lang, host: host, writer: writer}
+		p.entries[key] = e
+	}
+	e.count++
+}
+
+// run walks the top entries every interval and refreshes their cache
+// entry. It blocks until stop is closed.
+func (p *prefetcher) run(stop <-chan struct{}) {
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.refresh()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *prefetcher) refresh() {
+	for _, e := range p.top() {
+		ips, err := net.LookupIP(e.host)
+		if err != nil || len(ips) == 0 {
+			prefetchMissCounter.Inc()
+			continue
+		}
+		ip, q := ips[0], &geoipQuery{}
+		if err := p.f.db.Lookup(ip, q); err != nil {
+			prefetchMissCounter.Inc()
+			continue
+		}
+		bw := respBuff.Get().(*bytes.Buffer)
+		bw.Reset()
+		e.writer(bw, &http.Request{}, q.Record(ip, e.lang))
+		p.f.toCache(e.format, e.lang, e.host, "", bw.Bytes())
+		respBuff.Put(bw)
+		prefetchHitCounter.Inc()
+	}
+}
+
+// top returns up to topN entries ordered by request count, descending, and
+// resets the counters for the next window.
+func (p *prefetcher) top() []*prefetchEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	all := make([]*prefetchEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		all = append(all, e)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].count > all[j].count })
+	if len(all) > p.topN {
+		all = all[:p.topN]
+	}
+	p.entries = make(map[string]*prefetchEntry)
+	return all
+}
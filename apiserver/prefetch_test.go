@@ -0,0 +1,26 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package apiserver
+
+import "testing"
+
+func TestPrefetcherTrackSkipsQueryParameterizedFormats(t *testing.T) {
+	p := newPrefetcher(&apiHandler{}, 10, 0)
+	p.track("jsonp", "en", "8.8.8.8", jsonpWriter)
+	p.track("txt", "en", "8.8.8.8", txtWriter)
+	if len(p.entries) != 0 {
+		t.Fatalf("expected jsonp/txt to be skipped, got %d entries", len(p.entries))
+	}
+}
+
+func TestPrefetcherTrackBoundsEntries(t *testing.T) {
+	p := newPrefetcher(&apiHandler{}, 2, 0)
+	for i := 0; i < maxPrefetchEntriesFactor*p.topN+5; i++ {
+		p.track("json", "en", string(rune('a'+i%26))+string(rune(i)), jsonWriter)
+	}
+	if max := maxPrefetchEntriesFactor * p.topN; len(p.entries) > max {
+		t.Fatalf("entries grew past the bound: got %d, want <= %d", len(p.entries), max)
+	}
+}